@@ -1,17 +1,39 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
 	"log"
 	"maps"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"reflect"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
 	pulse "github.com/jfreymuth/pulse/proto"
 	"github.com/leberKleber/go-mpris"
 	"github.com/tmaxmax/go-sse"
@@ -20,45 +42,572 @@ import (
 const PREFIX = "org.mpris.MediaPlayer2."
 const IFACE = PREFIX + "Player"
 const PATH = "/org/mpris/MediaPlayer2"
+const TRACKLIST = PREFIX + "TrackList"
 
 var (
-	listenAddr = flag.String("listen", ":8908", "listen address")
-	verbose    = flag.Bool("verbose", false, "prints events if true")
+	listenAddr         = flag.String("listen", ":8908", "listen address")
+	ipcSocket          = flag.String("ipc-socket", "", "also stream the state as JSON lines to clients of this unix socket")
+	verbose            = flag.Bool("verbose", false, "prints events if true")
+	sseDelta           = flag.Bool("sse-delta", false, "after the initial snapshot, only publish fields that changed (full state at /state)")
+	sseReplay          = flag.Int("sse-replay", 0, "number of recent messages kept for replay to clients reconnecting with Last-Event-ID and for /events/recent (0 to disable, otherwise at least 2)")
+	sseRetry           = flag.Duration("sse-retry", 0, "reconnection delay hinted to SSE clients with the retry field (0 for the client default)")
+	startupDelay       = flag.Duration("startup-delay", 0, "wait this long, then re-enumerate players, before the first publish")
+	minPublishInterval = flag.Duration("min-publish-interval", 0, "publish at most once per interval, coalescing intermediate states")
+	coalesceWindow     = flag.Duration("coalesce-window", 0, "wait this long after a player or volume update so that close updates are published together")
+	positionInterval   = flag.Duration("position-interval", time.Second, "re-read the playing player's position at this interval, as MPRIS does not signal it (0 to disable)")
+	heartbeatState     = flag.Duration("heartbeat-state", 0, "re-publish the full state at this interval even when nothing changed")
+	titleField         = flag.String("title-field", "xesam:title", "comma-separated metadata keys to read the title from, first non-empty wins")
+	defaultPlayer      = flag.String("default-player", "", "bus name substring of the player to prefer when several are equally active")
+	activeCooldown     = flag.Duration("active-cooldown", 0, "keep the chosen active player for at least this long unless it stops, to avoid flapping")
+	ignorePaused       = flag.Bool("ignore-paused", false, "only consider playing players as the active player and action target")
+	stateFile          = flag.String("state-file", "", "file persisting the pinned active player across restarts")
+	dbusTimeout        = flag.Duration("dbus-timeout", 5*time.Second, "give up on DBus calls to a player after this long (0 to wait forever)")
+	previousRestart    = flag.Duration("previous-restart-threshold", 0, "past this far into a track, /previous restarts it instead of skipping back (0 to disable)")
+	stopAsPause        = flag.String("stop-as-pause", "", "regexp of player bus names for which /stop sends Pause instead of Stop")
+	volumeSnap         = flag.Int("volume-snap", 0, "round the result of /volume?delta=, in the direction of the change, to a multiple of this many percent (0 to disable)")
+	volumePoll         = flag.Duration("volume-poll", 0, "also poll the sink volume at this interval, for setups that miss pulse events")
+	notify             = flag.Bool("notify", false, "show a desktop notification when the active player's track changes")
+	muteSentinel       = flag.Bool("mute-sentinel", true, "deprecated: also toggle mute on /volume?level=-1 (use mute=toggle)")
+	playerVolume       = flag.Bool("player-volume", false, "publish and set the active player's own MPRIS volume instead of the sink's")
 )
 
 type playerState struct {
-	State  string `json:"state"`
-	Title  string `json:"title"`
-	Artist string `json:"artist"`
-	Player string `json:"player"`
-	Volume int    `json:"volume"`
-	Mute   bool   `json:"mute"`
+	State   string `json:"state"`
+	Title   string `json:"title"`
+	Artist  string `json:"artist"`
+	Player  string `json:"player"`
+	BusName string `json:"busName"`
+	Volume  int    `json:"volume"`
+	Mute    bool   `json:"mute"`
+	TrackID string `json:"trackid"`
+	ArtURL  string `json:"artUrl"`
+
+	SinkPort string `json:"sinkPort"`
+
+	Rating    float64 `json:"rating"`
+	PlayCount int     `json:"playCount"`
+
+	Position    int64  `json:"position"`
+	Length      int64  `json:"length"`
+	ElapsedText string `json:"elapsedText"`
+	LengthText  string `json:"lengthText"`
+
+	LoopStatus string `json:"loopStatus"`
+	Shuffle    bool   `json:"shuffle"`
+
+	CanControl   bool `json:"canControl"`
+	CanSeek      bool `json:"canSeek"`
+	HasTrackList bool `json:"hasTrackList"`
+
+	InstanceID string `json:"instanceId,omitempty"`
+
+	hasVolume    bool
+	canSetVolume bool
+	since        time.Time
+}
+
+type fieldNames map[string]string
+
+func (f fieldNames) String() string {
+	var pairs []string
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f fieldNames) Set(value string) error {
+	from, to, ok := strings.Cut(value, "=")
+	if !ok || from == "" || to == "" {
+		return errors.New("expected old=new")
+	}
+	if !isStateField(from) {
+		return fmt.Errorf("unknown field %q", from)
+	}
+	if isStateField(to) {
+		return fmt.Errorf("field %q already exists", to)
+	}
+	for k, v := range f {
+		if v == to && k != from {
+			return fmt.Errorf("field %q already renamed to %q", k, to)
+		}
+	}
+	f[from] = to
+	return nil
+}
+
+var renamedFields = fieldNames{}
+
+type fieldSet map[string]bool
+
+func (f fieldSet) String() string {
+	return strings.Join(slices.Sorted(maps.Keys(f)), ",")
+}
+
+func (f fieldSet) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !isStateField(name) {
+			return fmt.Errorf("unknown field %q", name)
+		}
+		f[name] = true
+	}
+	return nil
+}
+
+func isStateField(name string) bool {
+	t := reflect.TypeFor[playerState]()
+	for i := range t.NumField() {
+		if tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); tag == name {
+			return true
+		}
+	}
+	return false
+}
+
+var hiddenFields = fieldSet{}
+
+func (s playerState) MarshalJSON() ([]byte, error) {
+	type plain playerState
+	j, err := json.Marshal(plain(s))
+	if err != nil || len(renamedFields) == 0 && len(hiddenFields) == 0 {
+		return j, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(j, &fields); err != nil {
+		return nil, err
+	}
+	renamed := map[string]json.RawMessage{}
+	for k, v := range fields {
+		if hiddenFields[k] {
+			continue
+		}
+		if to, ok := renamedFields[k]; ok {
+			k = to
+		}
+		renamed[k] = v
+	}
+	return json.Marshal(renamed)
 }
 
 type playersState = map[string]playerState
 
+type macro struct {
+	name  string
+	steps []string
+}
+
+type macros []macro
+
+func (m *macros) String() string {
+	var defs []string
+	for _, mac := range *m {
+		defs = append(defs, mac.name+"="+strings.Join(mac.steps, ","))
+	}
+	return strings.Join(defs, " ")
+}
+
+var macroName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+var reservedRoutes = []string{
+	"active", "art", "audio-info", "changed-since", "controllable", "events", "monitor", "ndjson", "next", "now-playing",
+	"pause", "play", "player-mute", "players", "previous", "refresh", "restart", "sink-port", "solo", "state", "stop",
+	"tracklist", "volume",
+}
+
+func (m *macros) Set(value string) error {
+	name, steps, ok := strings.Cut(value, "=")
+	if !ok || !macroName.MatchString(name) {
+		return errors.New("expected name=step,step,...")
+	}
+	if slices.Contains(reservedRoutes, name) || slices.ContainsFunc(*m, func(mac macro) bool { return mac.name == name }) {
+		return fmt.Errorf("macro name %q is already taken", name)
+	}
+	mac := macro{name: name}
+	for _, step := range strings.Split(steps, ",") {
+		action, arg, _ := strings.Cut(step, ":")
+		switch action {
+		case "pause-all", "mute", "unmute":
+		case "set-volume":
+			if vol, err := strconv.Atoi(arg); err != nil || vol < 0 || vol > 100 {
+				return fmt.Errorf("%s: expected set-volume:0-100", step)
+			}
+		default:
+			return fmt.Errorf("unknown macro step %q", step)
+		}
+		mac.steps = append(mac.steps, step)
+	}
+	*m = append(*m, mac)
+	return nil
+}
+
+type macroResult struct {
+	Step  string `json:"step"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+var macroDefs = macros{}
+
+type actor struct {
+	actions chan interface{}
+	done    chan struct{}
+}
+
+func newActor() actor {
+	return actor{actions: make(chan interface{}), done: make(chan struct{})}
+}
+
+func (a actor) send(action interface{}) bool {
+	select {
+	case a.actions <- action:
+		return true
+	case <-a.done:
+		return false
+	}
+}
+
+var errUnavailable = errors.New("service unavailable")
+
+func sendResult(result chan<- error, err error) {
+	if result != nil {
+		result <- err
+	}
+}
+
+type trackState struct {
+	TrackID string `json:"trackid"`
+	Title   string `json:"title"`
+	Artist  string `json:"artist"`
+}
+
 func findActivePlayer(players playersState) string {
+	return selectPlayer(players, slices.Collect(maps.Keys(players)), "")
+}
+
+var strategies = []string{"", "rank", "recent", "playing-only"}
+
+func selectPlayer(players playersState, names []string, strategy string) string {
+	if strategy == "playing-only" || strategy == "" && *ignorePaused {
+		names = slices.DeleteFunc(names, func(n string) bool { return players[n].State != "playing" })
+	}
+	if strategy == "recent" && len(names) > 0 {
+		live := slices.DeleteFunc(slices.Clone(names), func(n string) bool { return players[n].State == "stopped" })
+		if len(live) > 0 {
+			names = live
+		}
+		return slices.MaxFunc(names, func(a, b string) int {
+			return cmp.Or(players[a].since.Compare(players[b].since), strings.Compare(b, a))
+		})
+	}
+	return pickPlayer(players, names)
+}
+
+func actionTarget(players playersState, pinned string, strategy string, skip ...string) string {
+	names := slices.DeleteFunc(slices.Collect(maps.Keys(players)), func(n string) bool { return slices.Contains(skip, players[n].State) })
+	if _, ok := players[pinned]; ok && strategy == "" {
+		names = slices.DeleteFunc(names, func(n string) bool { return n != pinned })
+	}
+	return selectPlayer(players, names, strategy)
+}
+
+func pickPlayer(players playersState, names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
 	rank := func(n string) int {
 		s := players[n]
 		return map[string]int{"playing": 2, "paused": 1, "stopped": 0}[s.State]
 	}
-	return slices.MaxFunc(slices.Collect(maps.Keys(players)), func(a, b string) int {
-		return rank(a) - rank(b)
+	preferred := func(n string) int {
+		if *defaultPlayer != "" && strings.Contains(n, *defaultPlayer) {
+			return 1
+		}
+		return 0
+	}
+	return slices.MaxFunc(names, func(a, b string) int {
+		return cmp.Or(rank(a)-rank(b), preferred(a)-preferred(b), strings.Compare(b, a))
 	})
 }
 
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func stateDelta(old, cur playerState) map[string]interface{} {
+	var o, n map[string]interface{}
+	j, _ := json.Marshal(old)
+	_ = json.Unmarshal(j, &o)
+	j, _ = json.Marshal(cur)
+	_ = json.Unmarshal(j, &n)
+	delta := map[string]interface{}{}
+	for k, v := range n {
+		if !reflect.DeepEqual(o[k], v) {
+			delta[k] = v
+		}
+	}
+	return delta
+}
+
+type connectionStatus struct {
+	Subsystem string `json:"subsystem"`
+	Status    string `json:"status"`
+}
+
+type recentEvent struct {
+	Event string          `json:"event,omitempty"`
+	Data  json.RawMessage `json:"data"`
+	Time  time.Time       `json:"time"`
+}
+
+type eventLog struct {
+	mu     sync.Mutex
+	events []recentEvent
+}
+
+func (l *eventLog) add(e recentEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+	if len(l.events) > *sseReplay {
+		l.events = l.events[len(l.events)-*sseReplay:]
+	}
+}
+
+func (l *eventLog) last(n int) []recentEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n = min(n, len(l.events))
+	return slices.Clone(l.events[len(l.events)-n:])
+}
+
+var recentEvents = &eventLog{}
+
 func publish(data interface{}, serv *sse.Server) {
+	publishEvent("", data, serv)
+}
+
+func newMessage(event string, data interface{}) (*sse.Message, []byte) {
+	msg := &sse.Message{Retry: *sseRetry}
+	if event != "" {
+		msg.Type = sse.Type(event)
+	}
 	j, _ := json.Marshal(data)
-	msg := &sse.Message{}
 	msg.AppendData(string(j))
+	return msg, j
+}
+
+func publishEvent(event string, data interface{}, serv *sse.Server) {
+	msg, j := newMessage(event, data)
 	serv.Publish(msg)
+	recentEvents.add(recentEvent{Event: event, Data: j, Time: time.Now()})
 	if *verbose {
 		log.Printf("published: %+v", data)
 	}
 }
 
-func parsePlayerState(p mpris.Player) *playerState {
-	s := playerState{}
+type snapshotReplayer struct {
+	sse.Replayer
+	snapshot func() *sse.Message
+}
+
+func (r snapshotReplayer) Put(msg *sse.Message, topics []string) (*sse.Message, error) {
+	if r.Replayer == nil {
+		return msg, nil
+	}
+	return r.Replayer.Put(msg, topics)
+}
+
+func (r snapshotReplayer) Replay(sub sse.Subscription) error {
+	if r.Replayer != nil {
+		if err := r.Replayer.Replay(sub); err != nil {
+			return err
+		}
+	}
+	msg := r.snapshot()
+	if msg == nil {
+		return nil
+	}
+	if err := sub.Client.Send(msg); err != nil {
+		return err
+	}
+	return sub.Client.Flush()
+}
+
+type playerProps map[string]dbus.Variant
+
+func propValue[T any](p playerProps, name string) (T, error) {
+	v, ok := p[name].Value().(T)
+	if !ok {
+		return v, fmt.Errorf("no %s property", name)
+	}
+	return v, nil
+}
+
+func (p playerProps) PlaybackStatus() (mpris.PlaybackStatus, error) {
+	v, err := propValue[string](p, "PlaybackStatus")
+	return mpris.PlaybackStatus(v), err
+}
+
+func (p playerProps) Metadata() (mpris.Metadata, error) {
+	v, err := propValue[map[string]dbus.Variant](p, "Metadata")
+	return mpris.Metadata(v), err
+}
+
+func (p playerProps) LoopStatus() (mpris.LoopStatus, error) {
+	v, err := propValue[string](p, "LoopStatus")
+	return mpris.LoopStatus(v), err
+}
+
+func (p playerProps) CanControl() (bool, error) { return propValue[bool](p, "CanControl") }
+func (p playerProps) CanSeek() (bool, error)    { return propValue[bool](p, "CanSeek") }
+func (p playerProps) Shuffle() (bool, error)    { return propValue[bool](p, "Shuffle") }
+func (p playerProps) Volume() (float64, error)  { return propValue[float64](p, "Volume") }
+func (p playerProps) Position() (int64, error)  { return propValue[int64](p, "Position") }
+
+type busPlayer struct {
+	playerProps
+	obj dbus.BusObject
+}
+
+func (p busPlayer) TrackMetadata(trackID dbus.ObjectPath) (mpris.Metadata, error) {
+	var metas []map[string]dbus.Variant
+	if err := p.obj.Call(TRACKLIST+".GetTracksMetadata", 0, []dbus.ObjectPath{trackID}).Store(&metas); err != nil {
+		return nil, err
+	}
+	if len(metas) == 0 {
+		return nil, fmt.Errorf("no metadata for track %s", trackID)
+	}
+	return mpris.Metadata(metas[0]), nil
+}
+
+func metadataArtist(m mpris.Metadata) string {
+	if artists, err := m.XESAMArtist(); err == nil {
+		return strings.Join(artists, ", ")
+	}
+	return ""
+}
+
+func metadataTitle(m mpris.Metadata) string {
+	for _, key := range append(strings.Split(*titleField, ","), "xesam:title") {
+		if title, ok := m[strings.TrimSpace(key)].Value().(string); ok && title != "" {
+			return title
+		}
+	}
+	return ""
+}
+
+type busConn interface {
+	AddMatchSignal(options ...dbus.MatchOption) error
+	Signal(ch chan<- *dbus.Signal)
+	BusObject() dbus.BusObject
+	Object(dest string, path dbus.ObjectPath) dbus.BusObject
+	Context() context.Context
+}
+
+type mprisPlayer interface {
+	PlaybackStatus() (mpris.PlaybackStatus, error)
+	Metadata() (mpris.Metadata, error)
+	CanControl() (bool, error)
+	Volume() (float64, error)
+	Position() (int64, error)
+	LoopStatus() (mpris.LoopStatus, error)
+	Shuffle() (bool, error)
+	CanSeek() (bool, error)
+}
+
+type trackMetadataReader interface {
+	TrackMetadata(trackID dbus.ObjectPath) (mpris.Metadata, error)
+}
+
+func metadataInt(m mpris.Metadata, key string) int64 {
+	switch v := m[key].Value().(type) {
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+func metadataTrackID(m mpris.Metadata) string {
+	switch v := m["mpris:trackid"].Value().(type) {
+	case dbus.ObjectPath:
+		return string(v)
+	case string:
+		return v
+	}
+	return ""
+}
+
+func canRestart(s playerState) bool {
+	return s.CanSeek && dbus.ObjectPath(s.TrackID).IsValid() && s.TrackID != PATH+"/TrackList/NoTrack"
+}
+
+func nowPlaying(s playerState) string {
+	track := s.Title
+	if s.Artist != "" {
+		track = s.Artist + " - " + s.Title
+	}
+	return fmt.Sprintf("%s: %s [%s]", s.Player, track, s.State)
+}
+
+func formatDuration(us int64) string {
+	secs := max(us, 0) / int64(time.Second/time.Microsecond)
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+type broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan []byte]struct{}
+}
+
+func (b *broadcaster) subscribe() chan []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = map[chan []byte]struct{}{}
+	}
+	ch := make(chan []byte, 16)
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+func (b *broadcaster) unsubscribe(ch chan []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, ch)
+}
+
+func (b *broadcaster) broadcast(data interface{}) {
+	j, _ := json.Marshal(data)
+	line := append(j, '\n')
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+func parsePlayerState(p mprisPlayer, hasTrackList bool) *playerState {
+	s := playerState{HasTrackList: hasTrackList}
 	ps, _ := p.PlaybackStatus()
 	if ps == "" {
 		return nil
@@ -70,24 +619,201 @@ func parsePlayerState(p mpris.Player) *playerState {
 	case mpris.PlaybackStatusPaused:
 		s.State = "paused"
 	case mpris.PlaybackStatusStopped:
-		return nil
+		s.State = "stopped"
+	}
+	s.Artist = metadataArtist(m)
+	s.Title = metadataTitle(m)
+	s.TrackID = metadataTrackID(m)
+	if tl, ok := p.(trackMetadataReader); ok && s.Title == "" && s.Artist == "" && s.TrackID != "" && hasTrackList {
+		if tm, err := tl.TrackMetadata(dbus.ObjectPath(s.TrackID)); err == nil {
+			s.Artist = metadataArtist(tm)
+			s.Title = metadataTitle(tm)
+		}
 	}
-	if artists, err := m.XESAMArtist(); err == nil && len(artists) > 0 {
-		s.Artist = strings.Join(artists, ", ")
+	s.ArtURL, _ = m["mpris:artUrl"].Value().(string)
+	s.Rating, _ = m["xesam:userRating"].Value().(float64)
+	s.PlayCount = int(metadataInt(m, "xesam:useCount"))
+	s.Length = metadataInt(m, "mpris:length")
+	s.Position, _ = p.Position()
+	s.ElapsedText = formatDuration(s.Position)
+	s.LengthText = formatDuration(s.Length)
+	if ls, err := p.LoopStatus(); err == nil {
+		s.LoopStatus = string(ls)
 	}
-	if title, err := m.XESAMTitle(); err == nil {
-		s.Title = title
+	s.Shuffle, _ = p.Shuffle()
+	s.CanControl, _ = p.CanControl()
+	s.CanSeek, _ = p.CanSeek()
+	if v, err := p.Volume(); err == nil {
+		s.Volume = int(math.Round(v * 100))
+		s.Mute = v == 0
+		s.hasVolume = true
 	}
 	return &s
 }
 
+type artInfo struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
+}
+
+func init() {
+	image.RegisterFormat("webp", "RIFF????WEBP", func(io.Reader) (image.Image, error) {
+		return nil, errors.New("webp: only the header can be decoded")
+	}, decodeWebPConfig)
+}
+
+func decodeWebPConfig(r io.Reader) (image.Config, error) {
+	h := make([]byte, 30)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return image.Config{}, err
+	}
+	data := h[20:]
+	switch string(h[12:16]) {
+	case "VP8 ":
+		if data[3] == 0x9d && data[4] == 0x01 && data[5] == 0x2a {
+			return image.Config{
+				Width:  int(binary.LittleEndian.Uint16(data[6:]) & 0x3fff),
+				Height: int(binary.LittleEndian.Uint16(data[8:]) & 0x3fff),
+			}, nil
+		}
+	case "VP8L":
+		if data[0] == 0x2f {
+			bits := binary.LittleEndian.Uint32(data[1:])
+			return image.Config{Width: int(bits&0x3fff) + 1, Height: int(bits>>14&0x3fff) + 1}, nil
+		}
+	case "VP8X":
+		return image.Config{
+			Width:  int(data[4]) | int(data[5])<<8 | int(data[6])<<16 + 1,
+			Height: int(data[7]) | int(data[8])<<8 | int(data[9])<<16 + 1,
+		}, nil
+	}
+	return image.Config{}, errors.New("webp: invalid header")
+}
+
+var artClient = &http.Client{Timeout: 10 * time.Second}
+
+func openArt(artURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(artURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return os.Open(u.Path)
+	case "http", "https":
+		resp, err := artClient.Get(artURL)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: %s", artURL, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return nil, fmt.Errorf("unsupported art URL %q", artURL)
+}
+
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Println(err)
+	}
+}
+
+type savedState struct {
+	Pinned string `json:"pinned"`
+}
+
+func loadSavedState(path string) savedState {
+	s := savedState{}
+	if path == "" {
+		return s
+	}
+	if j, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(j, &s)
+	}
+	return s
+}
+
+func writeSavedState(path string, s savedState) {
+	if path == "" {
+		return
+	}
+	j, _ := json.Marshal(s)
+	if err := os.WriteFile(path, j, 0o644); err != nil {
+		log.Println(err)
+	}
+}
+
+func withTimeout[T any](timeout time.Duration, f func() T) (T, bool) {
+	if timeout <= 0 {
+		return f(), true
+	}
+	type result struct {
+		v         T
+		recovered interface{}
+	}
+	res := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				res <- result{recovered: r}
+			}
+		}()
+		res <- result{v: f()}
+	}()
+	select {
+	case r := <-res:
+		if r.recovered != nil {
+			panic(r.recovered)
+		}
+		return r.v, true
+	case <-time.After(timeout):
+		var zero T
+		return zero, false
+	}
+}
+
 type actionPlay struct{ name string }
 type actionPause struct{ name string }
 type actionStop struct{ name string }
 type actionPrevious struct{ name string }
 type actionNext struct{ name string }
+type actionSetPlayerVolume struct {
+	name   string
+	volume float64
+}
+type actionPlayerMute struct {
+	name   string
+	mute   bool
+	result chan<- error
+}
+type actionPauseAll struct{ result chan<- error }
+type actionRestart struct{ name string }
+type actionSolo struct{ name string }
+type actionRefresh struct{}
+type actionPosition struct{ name string }
+type actionTrackList struct {
+	name  string
+	reply chan<- []trackState
+}
+type actionGoTo struct {
+	name    string
+	trackID dbus.ObjectPath
+}
 
-func mprisEvents(conn *dbus.Conn, stateChan chan<- playersState, actChan <-chan interface{}) {
+func mprisEvents(conn busConn, newPlayer func(name string) mprisPlayer, stateChan chan<- playersState, actChan <-chan interface{}, connChan chan<- connectionStatus) {
 	if err := conn.AddMatchSignal(
 		dbus.WithMatchObjectPath(PATH),
 		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
@@ -105,6 +831,7 @@ func mprisEvents(conn *dbus.Conn, stateChan chan<- playersState, actChan <-chan
 	}
 	dbusMessages := make(chan *dbus.Signal, 1)
 	conn.Signal(dbusMessages)
+	connChan <- connectionStatus{Subsystem: "dbus", Status: "up"}
 
 	dbusNames := map[string]string{}
 	allPlayers := map[string]playerState{}
@@ -123,16 +850,82 @@ func mprisEvents(conn *dbus.Conn, stateChan chan<- playersState, actChan <-chan
 		}
 	}
 
-	updateState := func(name string) bool {
-		p := mpris.NewPlayerWithConnection(name, conn)
-		state := parsePlayerState(p)
+	call := func(name string, method string, args ...interface{}) *dbus.Call {
+		ctx, cancel := context.WithCancel(context.Background())
+		if *dbusTimeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), *dbusTimeout)
+		}
+		defer cancel()
+		c := conn.Object(name, PATH).CallWithContext(ctx, method, 0, args...)
+		if errors.Is(c.Err, context.DeadlineExceeded) {
+			log.Printf("%s: %s timed out", name, method)
+		}
+		return c
+	}
+
+	getProperty := func(name string, iface string, prop string) (dbus.Variant, error) {
+		var v dbus.Variant
+		err := call(name, "org.freedesktop.DBus.Properties.Get", iface, prop).Store(&v)
+		return v, err
+	}
+
+	volumeWritable := map[string]bool{}
+	isVolumeWritable := func(name string) bool {
+		if w, ok := volumeWritable[name]; ok {
+			return w
+		}
+		var data string
+		if err := call(name, "org.freedesktop.DBus.Introspectable.Introspect").Store(&data); err != nil {
+			return false
+		}
+		var node introspect.Node
+		if err := xml.Unmarshal([]byte(data), &node); err != nil {
+			return false
+		}
+		volumeWritable[name] = false
+		for _, iface := range node.Interfaces {
+			for _, prop := range iface.Properties {
+				if iface.Name == IFACE && prop.Name == "Volume" {
+					volumeWritable[name] = prop.Access == "readwrite"
+				}
+			}
+		}
+		return volumeWritable[name]
+	}
+
+	mutedVolumes := map[string]float64{}
+
+	updateState := func(name string) (changed bool) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("%s: skipping player: %v", name, r)
+				changed = false
+			}
+		}()
+		state, ok := withTimeout(*dbusTimeout, func() *playerState {
+			v, _ := getProperty(name, strings.TrimSuffix(PREFIX, "."), "HasTrackList")
+			hasTrackList, _ := v.Value().(bool)
+			return parsePlayerState(newPlayer(name), hasTrackList)
+		})
+		if !ok {
+			log.Printf("%s: reading state timed out", name)
+			return false
+		}
 		if state == nil {
+			delete(volumeWritable, name)
+			delete(mutedVolumes, name)
 			if _, ok := allPlayers[name]; ok {
 				delete(allPlayers, name)
 				return true
 			}
 		} else {
 			state.Player = strings.TrimPrefix(name, PREFIX)
+			state.BusName = name
+			state.canSetVolume = state.hasVolume && state.CanControl && isVolumeWritable(name)
+			state.since = time.Now()
+			if prev, ok := allPlayers[name]; ok && prev.State == state.State {
+				state.since = prev.since
+			}
 			allPlayers[name] = *state
 			return true
 		}
@@ -144,57 +937,257 @@ func mprisEvents(conn *dbus.Conn, stateChan chan<- playersState, actChan <-chan
 			return false
 		}
 		getPlayerNames()
+		known := slices.Collect(maps.Values(dbusNames))
+		n := len(allPlayers)
+		for name := range allPlayers {
+			if !slices.Contains(known, name) {
+				delete(allPlayers, name)
+				delete(volumeWritable, name)
+				delete(mutedVolumes, name)
+			}
+		}
+		if len(allPlayers) != n {
+			stateChan <- maps.Clone(allPlayers)
+		}
 		return true
 	}
 
-	getPlayerNames()
-	for _, name := range dbusNames {
-		updateState(name)
+	rebuild := func() {
+		getPlayerNames()
+		clear(allPlayers)
+		clear(volumeWritable)
+		for _, name := range dbusNames {
+			updateState(name)
+		}
+		stateChan <- maps.Clone(allPlayers)
 	}
-	stateChan <- allPlayers
 
-	call := func(name string, method string) {
-		conn.Object(name, PATH).Call(IFACE+"."+method, 0)
+	rebuild()
+
+	trackList := func(name string) []trackState {
+		v, err := getProperty(name, TRACKLIST, "Tracks")
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			return nil
+		}
+		tracks := []trackState{}
+		ids, _ := v.Value().([]dbus.ObjectPath)
+		if len(ids) == 0 {
+			return tracks
+		}
+		var metas []map[string]dbus.Variant
+		if err := call(name, TRACKLIST+".GetTracksMetadata", ids).Store(&metas); err != nil {
+			log.Printf("%s: %v", name, err)
+			return nil
+		}
+		for _, m := range metas {
+			m := mpris.Metadata(m)
+			t := trackState{}
+			t.TrackID = metadataTrackID(m)
+			t.Artist = metadataArtist(m)
+			t.Title = metadataTitle(m)
+			tracks = append(tracks, t)
+		}
+		return tracks
+	}
+
+	restart := func(name string) {
+		call(name, IFACE+".SetPosition", dbus.ObjectPath(allPlayers[name].TrackID), int64(0))
+	}
+
+	pastRestartThreshold := func(name string) bool {
+		if *previousRestart <= 0 || !canRestart(allPlayers[name]) {
+			return false
+		}
+		v, err := getProperty(name, IFACE, "Position")
+		if err != nil {
+			return false
+		}
+		pos, ok := v.Value().(int64)
+		return ok && time.Duration(pos)*time.Microsecond > *previousRestart
+	}
+
+	down := func() {
+		log.Println("dbus connection lost")
+		connChan <- connectionStatus{Subsystem: "dbus", Status: "down"}
 	}
 
 	for {
 		select {
-		case m := <-dbusMessages:
+		case <-conn.Context().Done():
+			down()
+			return
+		case m, ok := <-dbusMessages:
+			if !ok {
+				down()
+				return
+			}
 			if maintainNames(m) {
 				continue
 			}
-			name := ""
-			var ok bool
-			if name, ok = dbusNames[m.Sender]; !ok {
+			name, known := dbusNames[m.Sender]
+			if !known {
 				continue
 			}
 			if updateState(name) {
-				stateChan <- allPlayers
+				stateChan <- maps.Clone(allPlayers)
 			}
 		case a := <-actChan:
 			switch a := a.(type) {
 			case actionPlay:
-				call(a.name, "Play")
+				call(a.name, IFACE+".Play")
 			case actionPause:
-				call(a.name, "Pause")
+				call(a.name, IFACE+".Pause")
 			case actionStop:
-				call(a.name, "Stop")
+				call(a.name, IFACE+".Stop")
 			case actionPrevious:
-				call(a.name, "Previous")
+				if pastRestartThreshold(a.name) {
+					restart(a.name)
+				} else {
+					call(a.name, IFACE+".Previous")
+				}
 			case actionNext:
-				call(a.name, "Next")
+				call(a.name, IFACE+".Next")
+			case actionPauseAll:
+				var errs []error
+				for name, s := range allPlayers {
+					if s.State == "playing" {
+						errs = append(errs, call(name, IFACE+".Pause").Err)
+					}
+				}
+				sendResult(a.result, errors.Join(errs...))
+			case actionSetPlayerVolume:
+				call(a.name, "org.freedesktop.DBus.Properties.Set", IFACE, "Volume", dbus.MakeVariant(a.volume))
+			case actionPlayerMute:
+				var err error
+				if vol, muted := mutedVolumes[a.name]; a.mute && !muted {
+					var v dbus.Variant
+					if v, err = getProperty(a.name, IFACE, "Volume"); err == nil {
+						vol, _ = v.Value().(float64)
+						err = call(a.name, "org.freedesktop.DBus.Properties.Set", IFACE, "Volume", dbus.MakeVariant(0.)).Err
+					}
+					if err == nil {
+						mutedVolumes[a.name] = vol
+					}
+				} else if !a.mute && muted {
+					if err = call(a.name, "org.freedesktop.DBus.Properties.Set", IFACE, "Volume", dbus.MakeVariant(vol)).Err; err == nil {
+						delete(mutedVolumes, a.name)
+					}
+				}
+				sendResult(a.result, err)
+			case actionRestart:
+				if canRestart(allPlayers[a.name]) {
+					restart(a.name)
+				}
+			case actionSolo:
+				for name, s := range allPlayers {
+					if name == a.name && s.State == "paused" {
+						call(name, IFACE+".Play")
+					} else if name != a.name && s.State == "playing" {
+						call(name, IFACE+".Pause")
+					}
+				}
+			case actionRefresh:
+				rebuild()
+			case actionPosition:
+				s, ok := allPlayers[a.name]
+				if !ok {
+					continue
+				}
+				v, err := getProperty(a.name, IFACE, "Position")
+				if pos, isInt := v.Value().(int64); err == nil && isInt && pos != s.Position {
+					s.Position = pos
+					s.ElapsedText = formatDuration(pos)
+					allPlayers[a.name] = s
+					stateChan <- maps.Clone(allPlayers)
+				}
+			case actionTrackList:
+				a.reply <- trackList(a.name)
+			case actionGoTo:
+				call(a.name, TRACKLIST+".GoTo", a.trackID)
 			}
 		}
 	}
 }
 
+func notifications(conn *dbus.Conn, tracks <-chan playerState) {
+	obj := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+	var id uint32
+	for s := range tracks {
+		hints := map[string]dbus.Variant{}
+		if s.ArtURL != "" {
+			hints["image-path"] = dbus.MakeVariant(s.ArtURL)
+		}
+		if err := obj.Call("org.freedesktop.Notifications.Notify", 0,
+			"mpris-remote", id, "", s.Title, s.Artist, []string{}, hints, int32(-1),
+		).Store(&id); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
 type volumeMute struct {
 	volume int
 	mute   bool
+	port   string
+}
+
+type volumeChange struct {
+	Volume int       `json:"volume"`
+	Mute   bool      `json:"mute"`
+	Time   time.Time `json:"time"`
+}
+
+func snapVolume(level, delta int) int {
+	level += delta
+	if step := float64(*volumeSnap); step > 0 && delta > 0 {
+		level = int(math.Ceil(float64(level)/step) * step)
+	} else if step > 0 && delta < 0 {
+		level = int(math.Floor(float64(level)/step) * step)
+	}
+	return min(max(level, 0), 100)
+}
+
+func volumeToDB(vol uint32) float64 {
+	return 60 * math.Log10(float64(vol)/float64(pulse.VolumeNorm))
+}
+
+func dbToVolume(db float64) uint32 {
+	return uint32(math.Round(float64(pulse.VolumeNorm) * math.Pow(10, db/60)))
+}
+
+var errUnknownPort = errors.New("no such port on the sink")
+
+type audioInfo struct {
+	Server  string `json:"server"`
+	Version string `json:"version"`
+}
+
+type actionSetVolume struct {
+	level      int
+	toggleMute bool
+	result     chan<- error
+}
+type actionSetMute struct {
+	mute   bool
+	result chan<- error
+}
+type actionSetSinkPort struct {
+	port   string
+	result chan<- error
 }
+type actionAdjustVolume struct {
+	delta      int
+	toggleMute bool
+}
+type actionAdjustVolumeDB struct{ delta float64 }
+type actionToggleMute struct{}
+type actionVolumeHistory struct{ reply chan<- []volumeChange }
+type actionAudioInfo struct{ reply chan<- audioInfo }
 
-func volumeEvents(volumeChan chan<- volumeMute, setVolumeChan <-chan int) {
+func volumeEvents(volumeChan chan<- volumeMute, actChan <-chan interface{}, connChan chan<- connectionStatus) {
 	volumePlease := make(chan struct{}, 1)
+	closed := make(chan struct{})
 	client, conn, err := pulse.Connect("")
 	if err != nil {
 		log.Fatalln(err)
@@ -205,6 +1198,8 @@ func volumeEvents(volumeChan chan<- volumeMute, setVolumeChan <-chan int) {
 			if val.Event.GetType() == pulse.EventChange && val.Event.GetFacility() == pulse.EventSink {
 				volumePlease <- struct{}{}
 			}
+		case *pulse.ConnectionClosed:
+			close(closed)
 		}
 	}
 	defer conn.Close()
@@ -214,66 +1209,190 @@ func volumeEvents(volumeChan chan<- volumeMute, setVolumeChan <-chan int) {
 	if err := client.Request(&pulse.Subscribe{Mask: pulse.SubscriptionMaskSink}, nil); err != nil {
 		log.Fatalln(err)
 	}
+	serverInfo := pulse.GetServerInfoReply{}
+	if err := client.Request(&pulse.GetServerInfo{}, &serverInfo); err != nil {
+		log.Println(err)
+	}
+	info := audioInfo{Server: serverInfo.PackageName, Version: serverInfo.PackageVersion}
 	volumePlease <- struct{}{}
+	up := true
+	connChan <- connectionStatus{Subsystem: "pulse", Status: "up"}
 	const DEFAULT_SINK = "@DEFAULT_SINK@"
 	getSinkInfo := func() (pulse.GetSinkInfoReply, error) {
 		repl := pulse.GetSinkInfoReply{}
-		if err := client.Request(&pulse.GetSinkInfo{SinkIndex: pulse.Undefined, SinkName: DEFAULT_SINK}, &repl); err != nil {
-			return repl, err
+		err := client.Request(&pulse.GetSinkInfo{SinkIndex: pulse.Undefined, SinkName: DEFAULT_SINK}, &repl)
+		if up != (err == nil) {
+			up = err == nil
+			status := connectionStatus{Subsystem: "pulse", Status: "up"}
+			if !up {
+				status.Status = "down"
+			}
+			connChan <- status
+		}
+		return repl, err
+	}
+	averageVolume := func(volumes pulse.ChannelVolumes) uint32 {
+		var acc int64
+		for _, vol := range volumes {
+			acc += int64(vol)
 		}
-		return repl, nil
+		return uint32(acc / int64(len(volumes)))
+	}
+	activePort := func(repl pulse.GetSinkInfoReply) string {
+		for _, port := range repl.Ports {
+			if port.Name == repl.ActivePortName {
+				return port.Description
+			}
+		}
+		return repl.ActivePortName
+	}
+	sinkLevel := func(repl pulse.GetSinkInfoReply) int {
+		return int(math.Round(float64(averageVolume(repl.ChannelVolumes)) / float64(pulse.VolumeNorm) * 100))
+	}
+	setVolume := func(repl pulse.GetSinkInfoReply, vol uint32) error {
+		volumes := pulse.ChannelVolumes{}
+		for range repl.ChannelVolumes {
+			volumes = append(volumes, vol)
+		}
+		return errors.Join(
+			client.Request(&pulse.SetSinkMute{SinkIndex: pulse.Undefined, SinkName: DEFAULT_SINK, Mute: false}, nil),
+			client.Request(&pulse.SetSinkVolume{SinkIndex: pulse.Undefined, SinkName: DEFAULT_SINK, ChannelVolumes: volumes}, nil),
+		)
+	}
+	const HISTORY_SIZE = 32
+	history := []volumeChange{}
+	var poll <-chan time.Time
+	if *volumePoll > 0 {
+		poll = time.Tick(*volumePoll)
 	}
 	for {
 		select {
+		case <-closed:
+			log.Println("pulse connection lost")
+			connChan <- connectionStatus{Subsystem: "pulse", Status: "down"}
+			return
+		case <-poll:
+			select {
+			case volumePlease <- struct{}{}:
+			default:
+			}
 		case <-volumePlease:
 			repl, err := getSinkInfo()
 			if err != nil {
 				continue
 			}
-			var acc int64
-			for _, vol := range repl.ChannelVolumes {
-				acc += int64(vol)
-			}
-			acc /= int64(len(repl.ChannelVolumes))
-			volumeChan <- volumeMute{
-				volume: int(float64(acc) / float64(pulse.VolumeNorm) * 100.0),
+			vm := volumeMute{
+				volume: sinkLevel(repl),
 				mute:   repl.Mute,
+				port:   activePort(repl),
 			}
-		case vol := <-setVolumeChan:
-			if vol == -1 {
+			if n := len(history); n == 0 || history[n-1].Volume != vm.volume || history[n-1].Mute != vm.mute {
+				history = append(history, volumeChange{Volume: vm.volume, Mute: vm.mute, Time: time.Now()})
+				if len(history) > HISTORY_SIZE {
+					history = history[1:]
+				}
+			}
+			volumeChan <- vm
+		case a := <-actChan:
+			switch a := a.(type) {
+			case actionToggleMute:
 				repl, err := getSinkInfo()
 				if err != nil {
 					continue
 				}
 				client.Request(&pulse.SetSinkMute{SinkIndex: pulse.Undefined, SinkName: DEFAULT_SINK, Mute: !repl.Mute}, nil)
-			} else {
+			case actionSetVolume:
+				repl, err := getSinkInfo()
+				if err == nil {
+					err = setVolume(repl, uint32(float64(a.level)*float64(pulse.VolumeNorm)/100.))
+				}
+				if err == nil && a.toggleMute && !repl.Mute {
+					err = client.Request(&pulse.SetSinkMute{SinkIndex: pulse.Undefined, SinkName: DEFAULT_SINK, Mute: true}, nil)
+				}
+				sendResult(a.result, err)
+			case actionSetSinkPort:
+				repl, err := getSinkInfo()
+				if err == nil {
+					err = errUnknownPort
+					for _, port := range repl.Ports {
+						if port.Name == a.port {
+							err = client.Request(&pulse.SetSinkPort{SinkIndex: pulse.Undefined, SinkName: DEFAULT_SINK, Port: a.port}, nil)
+						}
+					}
+				}
+				sendResult(a.result, err)
+			case actionSetMute:
+				sendResult(a.result, client.Request(&pulse.SetSinkMute{SinkIndex: pulse.Undefined, SinkName: DEFAULT_SINK, Mute: a.mute}, nil))
+			case actionAdjustVolume:
+				repl, err := getSinkInfo()
+				if err != nil {
+					continue
+				}
+				err = setVolume(repl, uint32(float64(snapVolume(sinkLevel(repl), a.delta))*float64(pulse.VolumeNorm)/100.))
+				if err == nil && a.toggleMute && !repl.Mute {
+					client.Request(&pulse.SetSinkMute{SinkIndex: pulse.Undefined, SinkName: DEFAULT_SINK, Mute: true}, nil)
+				}
+			case actionAdjustVolumeDB:
 				repl, err := getSinkInfo()
 				if err != nil {
 					continue
 				}
-				vol := uint32(float64(vol) * float64(pulse.VolumeNorm) / 100.)
-				volumes := pulse.ChannelVolumes{}
-				for range repl.ChannelVolumes {
-					volumes = append(volumes, vol)
+				const MIN_DB = -60.
+				db := MIN_DB
+				if vol := averageVolume(repl.ChannelVolumes); vol > 0 {
+					db = max(volumeToDB(vol), MIN_DB)
 				}
-				client.Request(&pulse.SetSinkMute{SinkIndex: pulse.Undefined, SinkName: DEFAULT_SINK, Mute: false}, nil)
-				client.Request(&pulse.SetSinkVolume{SinkIndex: pulse.Undefined, SinkName: DEFAULT_SINK, ChannelVolumes: volumes}, nil)
+				db += a.delta
+				vol := uint32(0)
+				if db > MIN_DB {
+					vol = min(dbToVolume(db), uint32(pulse.VolumeNorm))
+				}
+				setVolume(repl, vol)
+			case actionVolumeHistory:
+				a.reply <- slices.Clone(history)
+			case actionAudioInfo:
+				a.reply <- info
 			}
 		}
 	}
 }
 
 func main() {
+	flag.Var(renamedFields, "field-name", "rename a JSON field of the published state, as old=new (repeatable)")
+	flag.Var(hiddenFields, "hide-fields", "comma-separated JSON fields omitted from the published state (repeatable)")
+	flag.Var(&macroDefs, "macro", "serve /name running steps in order, as name=step,... with steps pause-all, mute, unmute, set-volume:N (repeatable)")
 	flag.Parse()
 
+	if *sseReplay < 0 || *sseReplay == 1 {
+		log.Fatalln("-sse-replay: must be 0 or at least 2")
+	}
+
+	var stopAsPauseRe *regexp.Regexp
+	if *stopAsPause != "" {
+		var err error
+		if stopAsPauseRe, err = regexp.Compile(*stopAsPause); err != nil {
+			log.Fatalln("-stop-as-pause:", err)
+		}
+	}
+
 	conn, err := dbus.SessionBus()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	instanceID := hex.EncodeToString(id)
+
+	var mu sync.RWMutex
 	allPlayers := playersState{}
-	playerActionChan := make(chan interface{}, 1)
-	setVolumeChan := make(chan int, 1)
+	state := playerState{InstanceID: instanceID}
+	var published *playerState
+	stateChanged := make(chan struct{})
+	saved := loadSavedState(*stateFile)
+	pinChan := make(chan string)
+	playerActor := newActor()
+	volumeActor := newActor()
 
 	logRequest := func(r *http.Request) {
 		if *verbose {
@@ -281,74 +1400,758 @@ func main() {
 		}
 	}
 
-	playerHandler := func(notState string, action func(name string) any) func(w http.ResponseWriter, r *http.Request) {
+	respond := func(w http.ResponseWriter, r *http.Request, changed <-chan struct{}) {
+		q := r.URL.Query()
+		if q.Get("wait") == "1" {
+			select {
+			case <-changed:
+			case <-time.After(time.Second):
+			}
+		}
+		if q.Get("include-state") == "1" {
+			mu.RLock()
+			s := state
+			mu.RUnlock()
+			writeJSON(w, s)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	dispatch := func(w http.ResponseWriter, r *http.Request, a actor, action interface{}) {
+		mu.RLock()
+		changed := stateChanged
+		mu.RUnlock()
+		if !a.send(action) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		respond(w, r, changed)
+	}
+
+	setPlayerHeader := func(w http.ResponseWriter, name string) {
+		w.Header().Set("X-Player", strings.TrimPrefix(name, PREFIX))
+	}
+
+	playerHandler := func(skip []string, action func(name string) any) func(w http.ResponseWriter, r *http.Request) {
 		return func(w http.ResponseWriter, r *http.Request) {
 			logRequest(r)
-			relevant := slices.DeleteFunc(slices.Collect(maps.Keys(allPlayers)), func(n string) bool { return allPlayers[n].State == notState })
-			if len(relevant) == 0 {
+			strategy := r.URL.Query().Get("strategy")
+			if !slices.Contains(strategies, strategy) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.RLock()
+			name := actionTarget(allPlayers, saved.Pinned, strategy, skip...)
+			mu.RUnlock()
+			if name == "" {
 				w.WriteHeader(http.StatusNoContent)
 				return
 			}
-			playerActionChan <- action(relevant[0])
-			w.WriteHeader(http.StatusOK)
+			setPlayerHeader(w, name)
+			dispatch(w, r, playerActor, action(name))
+		}
+	}
+
+	targetPlayer := func(r *http.Request) (string, int) {
+		mu.RLock()
+		defer mu.RUnlock()
+		if p := r.URL.Query().Get("player"); p != "" {
+			for n, s := range allPlayers {
+				if s.Player == p || n == p {
+					return n, http.StatusOK
+				}
+			}
+			return "", http.StatusNotFound
+		}
+		strategy := r.URL.Query().Get("strategy")
+		if !slices.Contains(strategies, strategy) {
+			return "", http.StatusBadRequest
+		}
+		if _, ok := allPlayers[saved.Pinned]; ok && strategy == "" {
+			return saved.Pinned, http.StatusOK
+		}
+		if name := selectPlayer(allPlayers, slices.Collect(maps.Keys(allPlayers)), strategy); name != "" {
+			return name, http.StatusOK
 		}
+		return "", http.StatusNoContent
 	}
 
-	http.HandleFunc("/play", playerHandler("playing", func(name string) any { return actionPlay{name: name} }))
-	http.HandleFunc("/pause", playerHandler("paused", func(name string) any { return actionPause{name: name} }))
-	http.HandleFunc("/stop", playerHandler("stopped", func(name string) any { return actionStop{name: name} }))
-	http.HandleFunc("/previous", playerHandler("", func(name string) any { return actionPrevious{name: name} }))
-	http.HandleFunc("/next", playerHandler("", func(name string) any { return actionNext{name: name} }))
+	trackListPlayer := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		name, status := targetPlayer(r)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return "", false
+		}
+		mu.RLock()
+		hasTrackList := allPlayers[name].HasTrackList
+		mu.RUnlock()
+		if !hasTrackList {
+			w.WriteHeader(http.StatusNotImplemented)
+			return "", false
+		}
+		return name, true
+	}
+
+	http.HandleFunc("/play", playerHandler([]string{"playing"}, func(name string) any { return actionPlay{name: name} }))
+	http.HandleFunc("/pause", playerHandler([]string{"paused", "stopped"}, func(name string) any { return actionPause{name: name} }))
+	http.HandleFunc("/stop", playerHandler([]string{"stopped"}, func(name string) any {
+		if stopAsPauseRe != nil && stopAsPauseRe.MatchString(name) {
+			return actionPause{name: name}
+		}
+		return actionStop{name: name}
+	}))
+	http.HandleFunc("/previous", playerHandler(nil, func(name string) any { return actionPrevious{name: name} }))
+	http.HandleFunc("/next", playerHandler(nil, func(name string) any { return actionNext{name: name} }))
+
+	http.HandleFunc("/tracklist", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		name, ok := trackListPlayer(w, r)
+		if !ok {
+			return
+		}
+		reply := make(chan []trackState)
+		if !playerActor.send(actionTrackList{name: name, reply: reply}) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		tracks := <-reply
+		if tracks == nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, tracks)
+	})
+
+	http.HandleFunc("/tracklist/goto", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		trackID := dbus.ObjectPath(r.URL.Query().Get("trackid"))
+		if !trackID.IsValid() {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		name, ok := trackListPlayer(w, r)
+		if !ok {
+			return
+		}
+		setPlayerHeader(w, name)
+		dispatch(w, r, playerActor, actionGoTo{name: name, trackID: trackID})
+	})
+
+	http.HandleFunc("/restart", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		name, status := targetPlayer(r)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		mu.RLock()
+		restartable := canRestart(allPlayers[name])
+		mu.RUnlock()
+		if !restartable {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		setPlayerHeader(w, name)
+		dispatch(w, r, playerActor, actionRestart{name: name})
+	})
+
+	http.HandleFunc("/solo", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if r.URL.Query().Get("player") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		name, status := targetPlayer(r)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		setPlayerHeader(w, name)
+		dispatch(w, r, playerActor, actionSolo{name: name})
+	})
+
+	http.HandleFunc("/active", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if r.URL.Query().Get("clear") == "1" {
+			pinChan <- ""
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.URL.Query().Get("player") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		name, status := targetPlayer(r)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		mu.RLock()
+		stopped := allPlayers[name].State == "stopped"
+		mu.RUnlock()
+		if stopped {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		pinChan <- name
+		setPlayerHeader(w, name)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	http.HandleFunc("/refresh", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		dispatch(w, r, playerActor, actionRefresh{})
+	})
 
 	http.HandleFunc("/volume", func(w http.ResponseWriter, r *http.Request) {
 		logRequest(r)
-		vol, err := strconv.Atoi(r.URL.Query().Get("level"))
+		q := r.URL.Query()
+		level, mute, delta := q.Get("level"), q.Get("mute"), q.Get("delta")
+		if level == "-1" && mute == "" && *muteSentinel {
+			log.Println("/volume?level=-1 is deprecated, use mute=toggle")
+			level, mute = "", "toggle"
+		}
+		vol, err := strconv.Atoi(level)
+		step, stepErr := strconv.Atoi(delta)
+		if level == "" && mute == "" && delta == "" || level != "" && err != nil || delta != "" && (level != "" || stepErr != nil) ||
+			!slices.Contains([]string{"", "toggle", "on", "off"}, mute) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.RLock()
+		changed := stateChanged
+		mu.RUnlock()
+		sent := true
+		if (0 < vol && vol < 100 || delta != "") && *playerVolume {
+			name, status := targetPlayer(r)
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			mu.RLock()
+			p := allPlayers[name]
+			mu.RUnlock()
+			if !p.canSetVolume {
+				w.WriteHeader(http.StatusNotImplemented)
+				return
+			}
+			if delta != "" {
+				vol = snapVolume(p.Volume, step)
+			}
+			setPlayerHeader(w, name)
+			sent = playerActor.send(actionSetPlayerVolume{name: name, volume: float64(vol) / 100})
+		} else if delta != "" || 0 < vol && vol < 100 {
+			if delta != "" {
+				sent = volumeActor.send(actionAdjustVolume{delta: step, toggleMute: mute == "toggle"})
+			} else {
+				sent = volumeActor.send(actionSetVolume{level: vol, toggleMute: mute == "toggle"})
+			}
+			if mute == "toggle" {
+				mute = ""
+			}
+		}
+		switch mute {
+		case "toggle":
+			sent = sent && volumeActor.send(actionToggleMute{})
+		case "on", "off":
+			sent = sent && volumeActor.send(actionSetMute{mute: mute == "on"})
+		}
+		if !sent {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		respond(w, r, changed)
+	})
+
+	http.HandleFunc("/player-mute", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		mute, err := strconv.ParseBool(r.URL.Query().Get("mute"))
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		if 0 < vol && vol < 100 || vol == -1 {
-			setVolumeChan <- vol
+		name, status := targetPlayer(r)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
 		}
-		w.WriteHeader(http.StatusOK)
+		mu.RLock()
+		canSetVolume := allPlayers[name].canSetVolume
+		changed := stateChanged
+		mu.RUnlock()
+		if !canSetVolume {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		setPlayerHeader(w, name)
+		result := make(chan error, 1)
+		if !playerActor.send(actionPlayerMute{name: name, mute: mute, result: result}) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if err := <-result; err != nil {
+			log.Printf("%s: %v", name, err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		respond(w, r, changed)
+	})
+
+	http.HandleFunc("/volume/db", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		delta, err := strconv.ParseFloat(r.URL.Query().Get("delta"), 64)
+		if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dispatch(w, r, volumeActor, actionAdjustVolumeDB{delta: delta})
+	})
+
+	http.HandleFunc("/sink-port", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		port := r.URL.Query().Get("name")
+		if port == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.RLock()
+		changed := stateChanged
+		mu.RUnlock()
+		result := make(chan error, 1)
+		if !volumeActor.send(actionSetSinkPort{port: port, result: result}) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if err := <-result; errors.Is(err, errUnknownPort) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		respond(w, r, changed)
+	})
+
+	http.HandleFunc("/volume/history", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		reply := make(chan []volumeChange)
+		if !volumeActor.send(actionVolumeHistory{reply: reply}) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, <-reply)
+	})
+
+	http.HandleFunc("/audio-info", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		reply := make(chan audioInfo)
+		if !volumeActor.send(actionAudioInfo{reply: reply}) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, <-reply)
+	})
+
+	http.HandleFunc("/players", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		mu.RLock()
+		players := slices.SortedFunc(maps.Values(allPlayers), func(a, b playerState) int {
+			return strings.Compare(a.Player, b.Player)
+		})
+		mu.RUnlock()
+		writeJSON(w, players)
+	})
+
+	http.HandleFunc("/controllable", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		mu.RLock()
+		names := []string{}
+		for _, p := range allPlayers {
+			if p.CanControl {
+				names = append(names, p.Player)
+			}
+		}
+		mu.RUnlock()
+		slices.Sort(names)
+		writeJSON(w, names)
+	})
+
+	http.HandleFunc("/now-playing", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		mu.RLock()
+		s := state
+		mu.RUnlock()
+		if s.State != "playing" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, nowPlaying(s))
+	})
+
+	http.HandleFunc("/changed-since", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		mu.RLock()
+		s := state
+		mu.RUnlock()
+		if s.State == "stopped" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if s.TrackID == r.URL.Query().Get("trackid") {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeJSON(w, trackState{TrackID: s.TrackID, Title: s.Title, Artist: s.Artist})
+	})
+
+	http.HandleFunc("/art/info", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		mu.RLock()
+		artURL := state.ArtURL
+		mu.RUnlock()
+		if artURL == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		art, err := openArt(artURL)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		defer art.Close()
+		config, format, err := image.DecodeConfig(art)
+		if err != nil {
+			log.Printf("%s: %v", artURL, err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, artInfo{Width: config.Width, Height: config.Height, Format: format})
 	})
 
-	monitor := &sse.Server{}
+	http.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		mu.RLock()
+		s := state
+		mu.RUnlock()
+		writeJSON(w, s)
+	})
+
+	for _, mac := range macroDefs {
+		http.HandleFunc("/"+mac.name, func(w http.ResponseWriter, r *http.Request) {
+			logRequest(r)
+			results := []macroResult{}
+			for _, step := range mac.steps {
+				result := make(chan error, 1)
+				sent := false
+				action, arg, _ := strings.Cut(step, ":")
+				switch action {
+				case "pause-all":
+					sent = playerActor.send(actionPauseAll{result: result})
+				case "mute", "unmute":
+					sent = volumeActor.send(actionSetMute{mute: action == "mute", result: result})
+				case "set-volume":
+					vol, _ := strconv.Atoi(arg)
+					sent = volumeActor.send(actionSetVolume{level: vol, result: result})
+				}
+				if !sent {
+					result <- errUnavailable
+				}
+				res := macroResult{Step: step, OK: true}
+				if err := <-result; err != nil {
+					res.OK = false
+					res.Error = err.Error()
+				}
+				results = append(results, res)
+			}
+			writeJSON(w, results)
+		})
+	}
+
+	lines := &broadcaster{}
+	streamLines := func(w io.Writer, flush func(), done <-chan struct{}) {
+		ch := lines.subscribe()
+		defer lines.unsubscribe(ch)
+		mu.RLock()
+		j, _ := json.Marshal(state)
+		mu.RUnlock()
+		line := append(j, '\n')
+		for {
+			if _, err := w.Write(line); err != nil {
+				return
+			}
+			flush()
+			select {
+			case <-done:
+				return
+			case line = <-ch:
+			}
+		}
+	}
+
+	http.HandleFunc("/ndjson", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		streamLines(w, flusher.Flush, r.Context().Done())
+	})
+
+	if *ipcSocket != "" {
+		_ = os.Remove(*ipcSocket)
+		l, err := net.Listen("unix", *ipcSocket)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				go func() {
+					defer c.Close()
+					done := make(chan struct{})
+					go func() {
+						_, _ = io.Copy(io.Discard, c)
+						close(done)
+					}()
+					streamLines(c, func() {}, done)
+				}()
+			}
+		}()
+	}
+
+	replayer := snapshotReplayer{snapshot: func() *sse.Message {
+		mu.RLock()
+		defer mu.RUnlock()
+		if published == nil {
+			return nil
+		}
+		msg, _ := newMessage("", *published)
+		return msg
+	}}
+	if *sseReplay > 0 {
+		finite, err := sse.NewFiniteReplayer(*sseReplay, true)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		replayer.Replayer = finite
+	}
+	monitor := &sse.Server{Provider: &sse.Joe{Replayer: replayer}}
 	http.Handle("/monitor", monitor)
 
-	go http.ListenAndServe(*listenAddr, nil)
+	http.HandleFunc("/events/recent", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		n := *sseReplay
+		if q := r.URL.Query().Get("n"); q != "" {
+			var err error
+			if n, err = strconv.Atoi(q); err != nil || n < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, recentEvents.last(n))
+	})
+
+	l, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	go http.Serve(l, nil)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	connChan := make(chan connectionStatus, 1)
 
 	stateChan := make(chan playersState, 1)
-	go mprisEvents(conn, stateChan, playerActionChan)
+	newPlayer := func(name string) mprisPlayer {
+		obj := conn.Object(name, PATH)
+		props := map[string]dbus.Variant{}
+		_ = obj.Call("org.freedesktop.DBus.Properties.GetAll", 0, IFACE).Store(&props)
+		return busPlayer{playerProps: props, obj: obj}
+	}
+	go func() {
+		mprisEvents(conn, newPlayer, stateChan, playerActor.actions, connChan)
+		close(playerActor.done)
+	}()
 
 	volumeChan := make(chan volumeMute, 1)
-	go volumeEvents(volumeChan, setVolumeChan)
+	go func() {
+		volumeEvents(volumeChan, volumeActor.actions, connChan)
+		close(volumeActor.done)
+	}()
+
+	notifyChan := make(chan playerState, 1)
+	if *notify {
+		go notifications(conn, notifyChan)
+	}
 
-	state := playerState{}
+	var startup <-chan time.Time
+	if *startupDelay > 0 {
+		startup = time.After(*startupDelay)
+	}
+	sink := volumeMute{}
+	pinSeen := false
+	subsystemsUp := map[string]bool{}
+	ready := false
+	var notified playerState
+	var lastPublish time.Time
+	var throttle <-chan time.Time
+	var activeName string
+	var activeSince time.Time
+	var cooldown <-chan time.Time
+	var coalesce <-chan time.Time
+	startCoalescing := func() {
+		if *coalesceWindow > 0 && coalesce == nil {
+			coalesce = time.After(*coalesceWindow)
+		}
+	}
+	var heartbeat <-chan time.Time
+	if *heartbeatState > 0 {
+		heartbeat = time.Tick(*heartbeatState)
+	}
+	var positionTick <-chan time.Time
+	if *positionInterval > 0 {
+		positionTick = time.Tick(*positionInterval)
+	}
 	for {
-		newState := state
 		select {
+		case <-startup:
+			startup = nil
+			go playerActor.send(actionRefresh{})
+			continue
 		case players := <-stateChan:
+			startCoalescing()
+			mu.Lock()
 			allPlayers = players
-			if len(players) == 0 {
-				newState.Player = ""
-				newState.Artist = ""
-				newState.Title = ""
-				newState.State = "stopped"
-			} else {
-				active := players[findActivePlayer(players)]
-				newState.Artist = active.Artist
-				newState.Title = active.Title
-				newState.Player = active.Player
-				newState.State = active.State
+			pinned, ok := players[saved.Pinned]
+			pinSeen = pinSeen || ok
+			unpin := saved.Pinned != "" && pinSeen && startup == nil && (!ok || pinned.State == "stopped")
+			if unpin {
+				saved.Pinned = ""
+				pinSeen = false
+			}
+			mu.Unlock()
+			if unpin {
+				writeSavedState(*stateFile, saved)
+			}
+		case name := <-pinChan:
+			pinSeen = name != ""
+			mu.Lock()
+			saved.Pinned = name
+			mu.Unlock()
+			writeSavedState(*stateFile, saved)
+		case sink = <-volumeChan:
+			startCoalescing()
+		case <-coalesce:
+			coalesce = nil
+		case c := <-connChan:
+			publishEvent("connection", c, monitor)
+			subsystemsUp[c.Subsystem] = c.Status == "up"
+			if !ready && subsystemsUp["dbus"] && subsystemsUp["pulse"] {
+				ready = true
+				sdNotify("READY=1")
+			}
+			continue
+		case <-stop:
+			sdNotify("STOPPING=1")
+			if *ipcSocket != "" {
+				_ = os.Remove(*ipcSocket)
+			}
+			return
+		case <-throttle:
+			throttle = nil
+		case <-cooldown:
+			cooldown = nil
+		case <-positionTick:
+			if state.State == "playing" {
+				select {
+				case playerActor.actions <- actionPosition{name: state.BusName}:
+				default:
+				}
+			}
+			continue
+		case <-heartbeat:
+			if startup == nil {
+				current := state
+				mu.Lock()
+				published = &current
+				mu.Unlock()
+				publish(current, monitor)
+				lines.broadcast(current)
+				lastPublish = time.Now()
+			}
+			continue
+		}
+		name := saved.Pinned
+		if _, ok := allPlayers[name]; !ok {
+			name = findActivePlayer(allPlayers)
+			remaining := *activeCooldown - time.Since(activeSince)
+			if cur, ok := allPlayers[activeName]; ok && cur.State != "stopped" && name != activeName && remaining > 0 {
+				name = activeName
+				cooldown = time.After(remaining)
 			}
-		case volume := <-volumeChan:
-			newState.Volume = volume.volume
-			newState.Mute = volume.mute
 		}
+		if name != activeName {
+			activeName = name
+			activeSince = time.Now()
+		}
+		active := playerState{State: "stopped"}
+		if p, ok := allPlayers[name]; ok {
+			active = p
+		}
+		if *notify && active.State == "playing" && active.Title != "" &&
+			(active.BusName != notified.BusName || active.TrackID != notified.TrackID || active.Title != notified.Title || active.Artist != notified.Artist) {
+			notified = active
+			select {
+			case notifyChan <- active:
+			default:
+			}
+		}
+		newState := active
+		newState.InstanceID = instanceID
+		newState.Volume = sink.volume
+		newState.Mute = sink.mute
+		newState.SinkPort = sink.port
+		if *playerVolume && active.hasVolume {
+			newState.Volume = active.Volume
+		}
+		mu.Lock()
 		if !reflect.DeepEqual(newState, state) {
-			state = newState
-			publish(state, monitor)
+			close(stateChanged)
+			stateChanged = make(chan struct{})
+		}
+		state = newState
+		mu.Unlock()
+		if startup != nil || throttle != nil || coalesce != nil {
+			continue
+		}
+		if published != nil && reflect.DeepEqual(newState, *published) {
+			continue
+		}
+		if wait := *minPublishInterval - time.Since(lastPublish); wait > 0 {
+			throttle = time.After(wait)
+			continue
+		}
+		previous := published
+		mu.Lock()
+		published = &newState
+		mu.Unlock()
+		if previous != nil && *sseDelta {
+			publish(stateDelta(*previous, newState), monitor)
+		} else {
+			publish(newState, monitor)
 		}
+		lines.broadcast(newState)
+		lastPublish = time.Now()
 	}
 }
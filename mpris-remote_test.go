@@ -0,0 +1,743 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	pulse "github.com/jfreymuth/pulse/proto"
+	"github.com/leberKleber/go-mpris"
+	"github.com/tmaxmax/go-sse"
+)
+
+type fakeCall struct {
+	dest   string
+	method string
+	args   []interface{}
+}
+
+type fakeBus struct {
+	mu      sync.Mutex
+	owners  map[string]string
+	props   map[string]map[string]dbus.Variant
+	calls   []fakeCall
+	signals chan<- *dbus.Signal
+	ctx     context.Context
+}
+
+func newFakeBus() *fakeBus {
+	return &fakeBus{
+		owners: map[string]string{},
+		props:  map[string]map[string]dbus.Variant{},
+		ctx:    context.Background(),
+	}
+}
+
+func (b *fakeBus) AddMatchSignal(options ...dbus.MatchOption) error { return nil }
+func (b *fakeBus) Signal(ch chan<- *dbus.Signal)                    { b.signals = ch }
+func (b *fakeBus) Context() context.Context                         { return b.ctx }
+func (b *fakeBus) BusObject() dbus.BusObject {
+	return b.Object("org.freedesktop.DBus", "/org/freedesktop/DBus")
+}
+func (b *fakeBus) Object(dest string, path dbus.ObjectPath) dbus.BusObject {
+	return &fakeObject{bus: b, dest: dest, path: path}
+}
+
+func (b *fakeBus) setOwner(name, owner string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if owner == "" {
+		delete(b.owners, name)
+	} else {
+		b.owners[name] = owner
+	}
+}
+
+func (b *fakeBus) nameOwnerChanged() {
+	b.signals <- &dbus.Signal{Sender: "org.freedesktop.DBus", Name: "org.freedesktop.DBus.NameOwnerChanged"}
+}
+
+func (b *fakeBus) propertiesChanged(owner string) {
+	b.signals <- &dbus.Signal{Sender: owner, Path: PATH, Name: "org.freedesktop.DBus.Properties.PropertiesChanged"}
+}
+
+func (b *fakeBus) recorded() []fakeCall {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.calls)
+}
+
+type fakeObject struct {
+	bus  *fakeBus
+	dest string
+	path dbus.ObjectPath
+}
+
+func (o *fakeObject) Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	o.bus.mu.Lock()
+	defer o.bus.mu.Unlock()
+	switch method {
+	case "org.freedesktop.DBus.ListNames":
+		var names []string
+		for name := range o.bus.owners {
+			names = append(names, name)
+		}
+		return &dbus.Call{Body: []interface{}{names}}
+	case "org.freedesktop.DBus.GetNameOwner":
+		return &dbus.Call{Body: []interface{}{o.bus.owners[args[0].(string)]}}
+	case "org.freedesktop.DBus.Properties.Get":
+		if v, ok := o.bus.props[o.dest][args[0].(string)+"."+args[1].(string)]; ok {
+			return &dbus.Call{Body: []interface{}{v}}
+		}
+		return &dbus.Call{Err: errors.New("no such property")}
+	}
+	o.bus.calls = append(o.bus.calls, fakeCall{dest: o.dest, method: method, args: args})
+	return &dbus.Call{Err: errors.New("not implemented")}
+}
+
+func (o *fakeObject) CallWithContext(ctx context.Context, method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	return o.Call(method, flags, args...)
+}
+
+func (o *fakeObject) Go(method string, flags dbus.Flags, ch chan *dbus.Call, args ...interface{}) *dbus.Call {
+	return o.Call(method, flags, args...)
+}
+
+func (o *fakeObject) GoWithContext(ctx context.Context, method string, flags dbus.Flags, ch chan *dbus.Call, args ...interface{}) *dbus.Call {
+	return o.Call(method, flags, args...)
+}
+
+func (o *fakeObject) AddMatchSignal(iface, member string, options ...dbus.MatchOption) *dbus.Call {
+	return &dbus.Call{}
+}
+
+func (o *fakeObject) RemoveMatchSignal(iface, member string, options ...dbus.MatchOption) *dbus.Call {
+	return &dbus.Call{}
+}
+
+func (o *fakeObject) GetProperty(p string) (dbus.Variant, error) {
+	o.bus.mu.Lock()
+	defer o.bus.mu.Unlock()
+	if v, ok := o.bus.props[o.dest][p]; ok {
+		return v, nil
+	}
+	return dbus.Variant{}, errors.New("no such property")
+}
+
+func (o *fakeObject) StoreProperty(p string, value interface{}) error {
+	v, err := o.GetProperty(p)
+	if err != nil {
+		return err
+	}
+	return dbus.Store([]interface{}{v.Value()}, value)
+}
+
+func (o *fakeObject) SetProperty(p string, v interface{}) error {
+	o.bus.mu.Lock()
+	defer o.bus.mu.Unlock()
+	if o.bus.props[o.dest] == nil {
+		o.bus.props[o.dest] = map[string]dbus.Variant{}
+	}
+	o.bus.props[o.dest][p] = dbus.MakeVariant(v)
+	return nil
+}
+
+func (o *fakeObject) Destination() string   { return o.dest }
+func (o *fakeObject) Path() dbus.ObjectPath { return o.path }
+
+type fakePlayer struct {
+	status     mpris.PlaybackStatus
+	title      string
+	artist     string
+	canControl bool
+	volume     *float64
+	position   int64
+	loopStatus mpris.LoopStatus
+	shuffle    bool
+	canSeek    bool
+	trackID    dbus.ObjectPath
+	panics     bool
+}
+
+func (p *fakePlayer) PlaybackStatus() (mpris.PlaybackStatus, error) {
+	if p.panics {
+		panic("player crashed")
+	}
+	return p.status, nil
+}
+func (p *fakePlayer) CanControl() (bool, error) { return p.canControl, nil }
+func (p *fakePlayer) Metadata() (mpris.Metadata, error) {
+	return mpris.Metadata{
+		"xesam:title":   dbus.MakeVariant(p.title),
+		"xesam:artist":  dbus.MakeVariant([]string{p.artist}),
+		"mpris:trackid": dbus.MakeVariant(p.trackID),
+	}, nil
+}
+func (p *fakePlayer) Position() (int64, error) { return p.position, nil }
+func (p *fakePlayer) LoopStatus() (mpris.LoopStatus, error) {
+	if p.loopStatus == "" {
+		return "", errors.New("no loop status")
+	}
+	return p.loopStatus, nil
+}
+func (p *fakePlayer) Shuffle() (bool, error) { return p.shuffle, nil }
+func (p *fakePlayer) CanSeek() (bool, error) { return p.canSeek, nil }
+func (p *fakePlayer) Volume() (float64, error) {
+	if p.volume == nil {
+		return 0, errors.New("no volume")
+	}
+	return *p.volume, nil
+}
+
+type fakePlayers struct {
+	mu      sync.Mutex
+	players map[string]*fakePlayer
+}
+
+func (f *fakePlayers) set(name string, p *fakePlayer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.players[name] = p
+}
+
+func (f *fakePlayers) newPlayer(name string) mprisPlayer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.players[name]; ok {
+		copied := *p
+		return &copied
+	}
+	return &fakePlayer{}
+}
+
+type harness struct {
+	bus       *fakeBus
+	players   *fakePlayers
+	stateChan chan playersState
+	actChan   chan interface{}
+	connChan  chan connectionStatus
+}
+
+func startHarness(t *testing.T, setup func(h *harness)) *harness {
+	t.Helper()
+	h := &harness{
+		bus:       newFakeBus(),
+		players:   &fakePlayers{players: map[string]*fakePlayer{}},
+		stateChan: make(chan playersState, 1),
+		actChan:   make(chan interface{}, 1),
+		connChan:  make(chan connectionStatus, 8),
+	}
+	if setup != nil {
+		setup(h)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	h.bus.ctx = ctx
+	go mprisEvents(h.bus, h.players.newPlayer, h.stateChan, h.actChan, h.connChan)
+	return h
+}
+
+func (h *harness) nextState(t *testing.T) playersState {
+	t.Helper()
+	select {
+	case s := <-h.stateChan:
+		return s
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for state")
+		return nil
+	}
+}
+
+// sync waits until every action queued before it has been processed.
+func (h *harness) sync() {
+	reply := make(chan []trackState)
+	h.actChan <- actionTrackList{name: "", reply: reply}
+	<-reply
+}
+
+func TestFindActivePlayer(t *testing.T) {
+	players := playersState{
+		PREFIX + "a": {State: "paused"},
+		PREFIX + "b": {State: "playing"},
+		PREFIX + "c": {State: "stopped"},
+	}
+	if got := findActivePlayer(players); got != PREFIX+"b" {
+		t.Errorf("findActivePlayer() = %q, want %q", got, PREFIX+"b")
+	}
+	if got := findActivePlayer(playersState{}); got != "" {
+		t.Errorf("findActivePlayer(empty) = %q, want empty", got)
+	}
+}
+
+func TestFindActivePlayerTie(t *testing.T) {
+	players := playersState{
+		PREFIX + "a":   {State: "paused"},
+		PREFIX + "mpv": {State: "paused"},
+		PREFIX + "z":   {State: "paused"},
+	}
+	if got := findActivePlayer(players); got != PREFIX+"a" {
+		t.Errorf("findActivePlayer() = %q, want %q", got, PREFIX+"a")
+	}
+	*defaultPlayer = "mpv"
+	t.Cleanup(func() { *defaultPlayer = "" })
+	if got := findActivePlayer(players); got != PREFIX+"mpv" {
+		t.Errorf("findActivePlayer() with -default-player = %q, want %q", got, PREFIX+"mpv")
+	}
+}
+
+func TestParsePlayerState(t *testing.T) {
+	volume := 0.5
+	s := parsePlayerState(&fakePlayer{
+		status:     mpris.PlaybackStatusPlaying,
+		title:      "Title",
+		artist:     "Artist",
+		canControl: true,
+		volume:     &volume,
+		position:   83_000_000,
+		loopStatus: mpris.LoopStatusPlaylist,
+		shuffle:    true,
+	}, false)
+	if s == nil {
+		t.Fatal("parsePlayerState() = nil")
+	}
+	want := playerState{
+		State:       "playing",
+		Title:       "Title",
+		Artist:      "Artist",
+		Volume:      50,
+		Position:    83_000_000,
+		ElapsedText: "1:23",
+		LengthText:  "0:00",
+		LoopStatus:  "Playlist",
+		Shuffle:     true,
+		CanControl:  true,
+		hasVolume:   true,
+	}
+	if *s != want {
+		t.Errorf("parsePlayerState() = %+v, want %+v", *s, want)
+	}
+	if s := parsePlayerState(&fakePlayer{status: mpris.PlaybackStatusStopped, title: "Title"}, false); s == nil || s.State != "stopped" || s.Title != "Title" {
+		t.Errorf("parsePlayerState(stopped) = %+v, want stopped with metadata", s)
+	}
+}
+
+func TestMprisEventsUpdates(t *testing.T) {
+	h := startHarness(t, func(h *harness) {
+		h.bus.setOwner(PREFIX+"mpv", ":1.1")
+		h.players.set(PREFIX+"mpv", &fakePlayer{status: mpris.PlaybackStatusPaused, title: "One"})
+		h.bus.props[PREFIX+"mpv"] = map[string]dbus.Variant{PREFIX + "HasTrackList": dbus.MakeVariant(true)}
+	})
+	if s := h.nextState(t); s[PREFIX+"mpv"].Title != "One" || s[PREFIX+"mpv"].Player != "mpv" || !s[PREFIX+"mpv"].HasTrackList {
+		t.Fatalf("initial state = %+v", s)
+	}
+
+	h.players.set(PREFIX+"mpv", &fakePlayer{status: mpris.PlaybackStatusPlaying, title: "Two"})
+	h.bus.propertiesChanged(":1.1")
+	if s := h.nextState(t); s[PREFIX+"mpv"].State != "playing" || s[PREFIX+"mpv"].Title != "Two" {
+		t.Fatalf("state after PropertiesChanged = %+v", s)
+	}
+
+	h.bus.setOwner(PREFIX+"vlc", ":1.2")
+	h.players.set(PREFIX+"vlc", &fakePlayer{status: mpris.PlaybackStatusPlaying, title: "Three"})
+	h.bus.nameOwnerChanged()
+	h.bus.propertiesChanged(":1.2")
+	if s := h.nextState(t); len(s) != 2 || s[PREFIX+"vlc"].Title != "Three" {
+		t.Fatalf("state after NameOwnerChanged = %+v", s)
+	}
+
+	h.players.set(PREFIX+"vlc", &fakePlayer{status: mpris.PlaybackStatusStopped, title: "Three"})
+	h.bus.propertiesChanged(":1.2")
+	if s := h.nextState(t); len(s) != 2 || s[PREFIX+"vlc"].State != "stopped" || s[PREFIX+"vlc"].Title != "Three" {
+		t.Fatalf("state after stop = %+v", s)
+	}
+
+	h.bus.setOwner(PREFIX+"vlc", "")
+	h.bus.nameOwnerChanged()
+	if s := h.nextState(t); len(s) != 1 {
+		t.Fatalf("state after quit = %+v", s)
+	}
+}
+
+func TestMprisEventsFailingPlayer(t *testing.T) {
+	h := startHarness(t, func(h *harness) {
+		h.bus.setOwner(PREFIX+"mpv", ":1.1")
+		h.players.set(PREFIX+"mpv", &fakePlayer{status: mpris.PlaybackStatusPlaying, title: "One"})
+		h.bus.setOwner(PREFIX+"broken", ":1.2")
+		h.players.set(PREFIX+"broken", &fakePlayer{panics: true})
+	})
+	if s := h.nextState(t); len(s) != 1 || s[PREFIX+"mpv"].Title != "One" {
+		t.Fatalf("initial state = %+v", s)
+	}
+
+	h.bus.propertiesChanged(":1.2")
+	h.players.set(PREFIX+"mpv", &fakePlayer{status: mpris.PlaybackStatusPlaying, title: "Two"})
+	h.bus.propertiesChanged(":1.1")
+	if s := h.nextState(t); len(s) != 1 || s[PREFIX+"mpv"].Title != "Two" {
+		t.Fatalf("state after failing player = %+v", s)
+	}
+}
+
+func TestMprisEventsActions(t *testing.T) {
+	h := startHarness(t, func(h *harness) {
+		h.bus.setOwner(PREFIX+"mpv", ":1.1")
+		h.players.set(PREFIX+"mpv", &fakePlayer{status: mpris.PlaybackStatusPlaying})
+		h.bus.setOwner(PREFIX+"vlc", ":1.2")
+		h.players.set(PREFIX+"vlc", &fakePlayer{status: mpris.PlaybackStatusPlaying, canSeek: true, trackID: "/track/1"})
+	})
+	h.nextState(t)
+
+	h.actChan <- actionPause{name: PREFIX + "mpv"}
+	h.actChan <- actionSolo{name: PREFIX + "vlc"}
+	h.actChan <- actionRestart{name: PREFIX + "mpv"}
+	h.actChan <- actionRestart{name: PREFIX + "vlc"}
+	h.sync()
+
+	want := []fakeCall{
+		{dest: PREFIX + "mpv", method: IFACE + ".Pause"},
+		{dest: PREFIX + "mpv", method: IFACE + ".Pause"},
+		{dest: PREFIX + "vlc", method: IFACE + ".SetPosition", args: []interface{}{dbus.ObjectPath("/track/1"), int64(0)}},
+	}
+	got := slices.DeleteFunc(h.bus.recorded(), func(c fakeCall) bool { return c.dest == "" })
+	if len(got) != len(want) {
+		t.Fatalf("calls = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].dest != want[i].dest || got[i].method != want[i].method || !reflect.DeepEqual(got[i].args, want[i].args) {
+			t.Errorf("call %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestMprisEventsSignalsClosed(t *testing.T) {
+	h := startHarness(t, nil)
+	h.nextState(t)
+	close(h.bus.signals)
+	for _, want := range []string{"up", "down"} {
+		select {
+		case c := <-h.connChan:
+			if c.Status != want {
+				t.Fatalf("connection status = %+v, want %s", c, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+}
+
+func TestVolumeDB(t *testing.T) {
+	if db := volumeToDB(uint32(pulse.VolumeNorm)); db != 0 {
+		t.Errorf("volumeToDB(norm) = %v, want 0", db)
+	}
+	if vol := dbToVolume(0); vol != uint32(pulse.VolumeNorm) {
+		t.Errorf("dbToVolume(0) = %v, want %v", vol, pulse.VolumeNorm)
+	}
+	for _, vol := range []uint32{0x1000, 0x8000, 0xc000} {
+		if got := dbToVolume(volumeToDB(vol)); got != vol {
+			t.Errorf("dbToVolume(volumeToDB(%v)) = %v", vol, got)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for us, want := range map[int64]string{
+		0:             "0:00",
+		83_000_000:    "1:23",
+		245_500_000:   "4:05",
+		3_723_000_000: "1:02:03",
+		-1:            "0:00",
+	} {
+		if got := formatDuration(us); got != want {
+			t.Errorf("formatDuration(%d) = %q, want %q", us, got, want)
+		}
+	}
+}
+
+func TestMacrosSet(t *testing.T) {
+	var m macros
+	if err := m.Set("panic=pause-all,mute,set-volume:20"); err != nil {
+		t.Fatalf("Set() = %v", err)
+	}
+	if len(m) != 1 || m[0].name != "panic" || !slices.Equal(m[0].steps, []string{"pause-all", "mute", "set-volume:20"}) {
+		t.Errorf("macros = %+v", m)
+	}
+	for _, bad := range []string{"panic", "Panic=mute", "other=explode", "other=set-volume:200", "other=set-volume", "panic=mute", "play=mute", "volume=mute"} {
+		if err := m.Set(bad); err == nil {
+			t.Errorf("Set(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestParsePlayerProps(t *testing.T) {
+	s := parsePlayerState(playerProps{
+		"PlaybackStatus": dbus.MakeVariant("Paused"),
+		"Metadata": dbus.MakeVariant(map[string]dbus.Variant{
+			"xesam:title":  dbus.MakeVariant("Title"),
+			"mpris:length": dbus.MakeVariant(int64(245_000_000)),
+		}),
+		"Position":   dbus.MakeVariant(int64(1_000_000)),
+		"LoopStatus": dbus.MakeVariant("Track"),
+		"CanSeek":    dbus.MakeVariant(true),
+	}, false)
+	if s == nil {
+		t.Fatal("parsePlayerState() = nil")
+	}
+	if s.State != "paused" || s.Title != "Title" || s.LengthText != "4:05" || s.ElapsedText != "0:01" || s.LoopStatus != "Track" || !s.CanSeek || s.hasVolume {
+		t.Errorf("parsePlayerState() = %+v", *s)
+	}
+	if s := parsePlayerState(playerProps{}, false); s != nil {
+		t.Errorf("parsePlayerState(empty) = %+v, want nil", *s)
+	}
+}
+
+func TestNowPlaying(t *testing.T) {
+	if got := nowPlaying(playerState{Player: "mpv", Artist: "Artist", Title: "Title", State: "playing"}); got != "mpv: Artist - Title [playing]" {
+		t.Errorf("nowPlaying() = %q", got)
+	}
+	if got := nowPlaying(playerState{Player: "radio", Title: "Stream", State: "paused"}); got != "radio: Stream [paused]" {
+		t.Errorf("nowPlaying() = %q", got)
+	}
+}
+
+func TestSelectPlayerStrategy(t *testing.T) {
+	now := time.Now()
+	players := playersState{
+		PREFIX + "a": {State: "paused", since: now},
+		PREFIX + "b": {State: "playing", since: now.Add(-time.Minute)},
+		PREFIX + "c": {State: "paused", since: now.Add(-time.Hour)},
+	}
+	names := func(p playersState) []string { return slices.Collect(maps.Keys(p)) }
+	for strategy, want := range map[string]string{
+		"":             PREFIX + "b",
+		"rank":         PREFIX + "b",
+		"recent":       PREFIX + "a",
+		"playing-only": PREFIX + "b",
+	} {
+		if got := selectPlayer(players, names(players), strategy); got != want {
+			t.Errorf("selectPlayer(%q) = %q, want %q", strategy, got, want)
+		}
+	}
+	delete(players, PREFIX+"b")
+	if got := selectPlayer(players, names(players), "playing-only"); got != "" {
+		t.Errorf("selectPlayer(playing-only) without playing = %q, want empty", got)
+	}
+}
+
+func TestDecodeWebPConfig(t *testing.T) {
+	header := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x00\x00\x00\x00\x7f\x02\x00\xdf\x01\x00")
+	config, format, err := image.DecodeConfig(bytes.NewReader(header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "webp" || config.Width != 640 || config.Height != 480 {
+		t.Errorf("DecodeConfig() = %dx%d %s, want 640x480 webp", config.Width, config.Height, format)
+	}
+}
+
+func TestEventLog(t *testing.T) {
+	*sseReplay = 3
+	t.Cleanup(func() { *sseReplay = 0 })
+	l := &eventLog{}
+	for i := range 5 {
+		l.add(recentEvent{Data: json.RawMessage(strconv.Itoa(i))})
+	}
+	var got []string
+	for _, e := range l.last(2) {
+		got = append(got, string(e.Data))
+	}
+	if want := []string{"3", "4"}; !slices.Equal(got, want) {
+		t.Errorf("last(2) = %v, want %v", got, want)
+	}
+	if n := len(l.last(10)); n != 3 {
+		t.Errorf("len(last(10)) = %d, want 3", n)
+	}
+}
+
+type fakeTrackListPlayer struct {
+	*fakePlayer
+	tracks map[dbus.ObjectPath]mpris.Metadata
+}
+
+func (p fakeTrackListPlayer) TrackMetadata(trackID dbus.ObjectPath) (mpris.Metadata, error) {
+	if m, ok := p.tracks[trackID]; ok {
+		return m, nil
+	}
+	return nil, errors.New("no such track")
+}
+
+func TestParsePlayerStateTrackListFallback(t *testing.T) {
+	s := parsePlayerState(fakeTrackListPlayer{
+		fakePlayer: &fakePlayer{status: mpris.PlaybackStatusPlaying, trackID: "/track/1"},
+		tracks: map[dbus.ObjectPath]mpris.Metadata{
+			"/track/1": {"xesam:title": dbus.MakeVariant("Title"), "xesam:artist": dbus.MakeVariant([]string{"Artist"})},
+		},
+	}, true)
+	if s == nil || s.Title != "Title" || s.Artist != "Artist" {
+		t.Errorf("parsePlayerState() = %+v, want title and artist from the track list", s)
+	}
+	s = parsePlayerState(fakeTrackListPlayer{fakePlayer: &fakePlayer{status: mpris.PlaybackStatusPlaying, trackID: "/track/1"}}, false)
+	if s == nil || s.Title != "" {
+		t.Errorf("parsePlayerState() without track list = %+v, want no title", s)
+	}
+}
+
+func TestHideFields(t *testing.T) {
+	if err := hiddenFields.Set("artUrl, trackid"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clear(hiddenFields) })
+	if err := (fieldSet{}).Set("title,nope"); err == nil {
+		t.Error("Set() with an unknown field succeeded")
+	}
+	j, err := json.Marshal(playerState{Title: "Title", ArtURL: "file:///art.png", TrackID: "/track/1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	_ = json.Unmarshal(j, &fields)
+	for _, k := range []string{"artUrl", "trackid"} {
+		if _, ok := fields[k]; ok {
+			t.Errorf("marshaled state has hidden field %q: %s", k, j)
+		}
+	}
+	if fields["title"] != "Title" {
+		t.Errorf("marshaled state = %s, want title kept", j)
+	}
+}
+
+func TestFieldNamesSet(t *testing.T) {
+	f := fieldNames{}
+	if err := f.Set("title=name"); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"nope=x", "artist=title", "artist=name", "title"} {
+		if err := f.Set(v); err == nil {
+			t.Errorf("Set(%q) succeeded", v)
+		}
+	}
+	if err := f.Set("title=song"); err != nil || f.String() != "title=song" {
+		t.Errorf("Set(%q) = %v, fields %q", "title=song", err, f)
+	}
+}
+
+func TestSnapVolume(t *testing.T) {
+	*volumeSnap = 5
+	t.Cleanup(func() { *volumeSnap = 0 })
+	for _, c := range []struct{ level, delta, want int }{
+		{50, 2, 55},
+		{50, -2, 45},
+		{47, 5, 55},
+		{33, -5, 25},
+		{2, -5, 0},
+		{97, 5, 100},
+		{50, 0, 50},
+	} {
+		if got := snapVolume(c.level, c.delta); got != c.want {
+			t.Errorf("snapVolume(%d, %d) = %d, want %d", c.level, c.delta, got, c.want)
+		}
+	}
+}
+
+func TestCanRestart(t *testing.T) {
+	for s, want := range map[playerState]bool{
+		{CanSeek: true, TrackID: "/track/1"}:                  true,
+		{CanSeek: false, TrackID: "/track/1"}:                 false,
+		{CanSeek: true}:                                       false,
+		{CanSeek: true, TrackID: "not a path"}:                false,
+		{CanSeek: true, TrackID: PATH + "/TrackList/NoTrack"}: false,
+	} {
+		if got := canRestart(s); got != want {
+			t.Errorf("canRestart(%+v) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestMprisEventsTrackList(t *testing.T) {
+	h := startHarness(t, func(h *harness) {
+		h.bus.setOwner(PREFIX+"mpv", ":1.1")
+		h.players.set(PREFIX+"mpv", &fakePlayer{status: mpris.PlaybackStatusPlaying})
+		h.bus.props[PREFIX+"mpv"] = map[string]dbus.Variant{TRACKLIST + ".Tracks": dbus.MakeVariant([]dbus.ObjectPath{})}
+	})
+	h.nextState(t)
+	for name, empty := range map[string]bool{PREFIX + "mpv": true, PREFIX + "vlc": false} {
+		reply := make(chan []trackState)
+		h.actChan <- actionTrackList{name: name, reply: reply}
+		if tracks := <-reply; (tracks != nil) != empty || len(tracks) != 0 {
+			t.Errorf("trackList(%s) = %#v, want empty %v", name, tracks, empty)
+		}
+	}
+}
+
+type fakeMessageWriter struct{ sent chan *sse.Message }
+
+func (w fakeMessageWriter) Send(m *sse.Message) error { w.sent <- m; return nil }
+func (w fakeMessageWriter) Flush() error              { return nil }
+
+func TestSnapshotReplayer(t *testing.T) {
+	joe := &sse.Joe{Replayer: snapshotReplayer{snapshot: func() *sse.Message {
+		msg, _ := newMessage("", playerState{Title: "Snapshot"})
+		return msg
+	}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	client := fakeMessageWriter{sent: make(chan *sse.Message, 2)}
+	go joe.Subscribe(ctx, sse.Subscription{Client: client, Topics: []string{sse.DefaultTopic}})
+	select {
+	case m := <-client.sent:
+		if !strings.Contains(m.String(), `"title":"Snapshot"`) {
+			t.Errorf("first message = %q, want the snapshot", m.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the snapshot")
+	}
+}
+
+func TestActionTargetSkipsStopped(t *testing.T) {
+	players := playersState{PREFIX + "mpv": {State: "stopped"}}
+	if got := actionTarget(players, "", "", "paused", "stopped"); got != "" {
+		t.Errorf("pause target = %q, want none", got)
+	}
+	players[PREFIX+"vlc"] = playerState{State: "playing"}
+	if got := actionTarget(players, "", "", "paused", "stopped"); got != PREFIX+"vlc" {
+		t.Errorf("pause target = %q, want %q", got, PREFIX+"vlc")
+	}
+}
+
+func TestSelectPlayerRecentSkipsStopped(t *testing.T) {
+	now := time.Now()
+	players := playersState{
+		PREFIX + "mpv": {State: "stopped", since: now},
+		PREFIX + "vlc": {State: "playing", since: now.Add(-time.Hour)},
+	}
+	names := slices.Collect(maps.Keys(players))
+	if got := selectPlayer(players, names, "recent"); got != PREFIX+"vlc" {
+		t.Errorf("selectPlayer(recent) = %q, want %q", got, PREFIX+"vlc")
+	}
+	delete(players, PREFIX+"vlc")
+	if got := selectPlayer(players, []string{PREFIX + "mpv"}, "recent"); got != PREFIX+"mpv" {
+		t.Errorf("selectPlayer(recent) with only stopped = %q, want %q", got, PREFIX+"mpv")
+	}
+}
+
+func TestMprisEventsPosition(t *testing.T) {
+	h := startHarness(t, func(h *harness) {
+		h.bus.setOwner(PREFIX+"mpv", ":1.1")
+		h.players.set(PREFIX+"mpv", &fakePlayer{status: mpris.PlaybackStatusPlaying})
+		h.bus.props[PREFIX+"mpv"] = map[string]dbus.Variant{IFACE + ".Position": dbus.MakeVariant(int64(83_000_000))}
+	})
+	h.nextState(t)
+	h.actChan <- actionPosition{name: PREFIX + "mpv"}
+	if s := h.nextState(t)[PREFIX+"mpv"]; s.Position != 83_000_000 || s.ElapsedText != "1:23" {
+		t.Errorf("state after position refresh = %+v", s)
+	}
+}